@@ -0,0 +1,154 @@
+package dht
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNetworking is a minimal in-memory networking implementation that lets
+// iterate() be driven in tests without opening real sockets.
+type fakeNetworking struct {
+	mu       sync.Mutex
+	sent     []*message
+	handlers map[string]func(q *message) *message
+}
+
+func (f *fakeNetworking) init()                              {}
+func (f *fakeNetworking) createSocket(ip, port string) error { return nil }
+func (f *fakeNetworking) listen() error                      { return nil }
+func (f *fakeNetworking) getMessage() *message               { return nil }
+func (f *fakeNetworking) getMessageFin()                     {}
+func (f *fakeNetworking) disconnect() error                  { return nil }
+
+func (f *fakeNetworking) sendMessage(msg *message, counter int64, expectResponse bool) (chan *message, error) {
+	f.mu.Lock()
+	f.sent = append(f.sent, msg)
+	f.mu.Unlock()
+
+	ch := make(chan *message, 1)
+	if !expectResponse {
+		return ch, nil
+	}
+
+	handler := f.handlers[string(msg.Receiver.ID)]
+	if handler == nil {
+		ch <- &message{Error: errors.New("no handler for receiver")}
+		return ch, nil
+	}
+	ch <- handler(msg)
+	return ch, nil
+}
+
+func newTestNode(t *testing.T, port int) *node {
+	t.Helper()
+	id, err := newID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := newNode(&NetworkNode{})
+	n.ID = id
+	n.IP = net.ParseIP("127.0.0.1")
+	n.Port = port
+	return n
+}
+
+func newTestDHT(self *node) (*DHT, *fakeNetworking) {
+	netw := &fakeNetworking{handlers: make(map[string]func(q *message) *message)}
+	dht := &DHT{}
+	dht.ht = &hashTable{Self: self.NetworkNode, RoutingTable: make([][]*node, len(self.ID)*8), mutex: &sync.Mutex{}}
+	dht.networking = netw
+	dht.options = &Options{AllowLAN: true}
+	dht.replacements = make(map[int][]*node)
+	dht.timestamps = make(map[string]*nodeTimestamps)
+	dht.bucketLastLookup = make(map[int]time.Time)
+	dht.netSet = &DistinctNetSet{Subnet4: 24, Subnet6: 48, Limit: maxPerSubnet}
+	dht.tokens = newTokenManager()
+	dht.providerStore = newMemoryProviderStore()
+	dht.providedKeys = make(map[string]bool)
+	dht.stop = make(chan struct{})
+	return dht, netw
+}
+
+// TestFindValueCachesAtClosestMiss performs a Get-equivalent lookup where
+// the value is only held by a far node reached through a closer
+// intermediate, and asserts that the closer node - which answered without
+// the value - receives a cache-store for it, per the standard Kademlia
+// caching rule.
+func TestFindValueCachesAtClosestMiss(t *testing.T) {
+	self := newTestNode(t, 3000)
+	closeNode := newTestNode(t, 3001)
+	farNode := newTestNode(t, 3002)
+
+	// Key distance is driven entirely by XOR to key, so leaving closeNode
+	// and farNode's IDs fully random (as newTestNode does by default)
+	// makes it a coin flip which one sorts first. Pin the key to
+	// closeNode's own ID - the minimum possible distance - and derive
+	// farNode's ID from it by flipping its leading (most significant)
+	// byte, much as randomIDInBucket copies an ID and flips a bit to land
+	// in a specific, predictable part of the keyspace. That guarantees
+	// closeNode sorts first every run.
+	key := append([]byte(nil), closeNode.ID...)
+	farNode.ID = append([]byte(nil), closeNode.ID...)
+	farNode.ID[0] ^= 0xFF
+
+	dht, netw := newTestDHT(self)
+
+	value := []byte("test-value")
+	closeToken := []byte("close-token")
+
+	netw.handlers[string(closeNode.ID)] = func(q *message) *message {
+		return &message{
+			Sender:   closeNode.NetworkNode,
+			Receiver: self.NetworkNode,
+			Type:     messageTypeResponseFindValue,
+			Data: &responseDataFindValue{
+				Closest: []*NetworkNode{farNode.NetworkNode},
+				Token:   closeToken,
+			},
+		}
+	}
+	netw.handlers[string(farNode.ID)] = func(q *message) *message {
+		return &message{
+			Sender:   farNode.NetworkNode,
+			Receiver: self.NetworkNode,
+			Type:     messageTypeResponseFindValue,
+			Data:     &responseDataFindValue{Value: value},
+		}
+	}
+
+	index := dht.ht.getBucketIndexFromDifferingBit(self.ID, closeNode.ID)
+	dht.ht.RoutingTable[index] = []*node{closeNode}
+
+	got, _, err := dht.iterate(iterateFindValue, key, nil, time.Time{}, false)
+	if err != nil {
+		t.Fatalf("iterate returned error: %v", err)
+	}
+	if !bytes.Equal(got, value) {
+		t.Fatalf("got value %q, want %q", got, value)
+	}
+
+	var cached *queryDataStore
+	var cachedReceiver *NetworkNode
+	for _, sent := range netw.sent {
+		if sent.Type == messageTypeQueryStore {
+			cached = sent.Data.(*queryDataStore)
+			cachedReceiver = sent.Receiver
+		}
+	}
+	if cached == nil {
+		t.Fatal("expected a cache-store to be sent to the closer node, got none")
+	}
+	if !bytes.Equal(cachedReceiver.ID, closeNode.ID) {
+		t.Fatalf("cache-store sent to %x, want the closer node %x", cachedReceiver.ID, closeNode.ID)
+	}
+	if !bytes.Equal(cached.Data, value) {
+		t.Fatalf("cached value = %q, want %q", cached.Data, value)
+	}
+	if !bytes.Equal(cached.Token, closeToken) {
+		t.Fatalf("cached store used token %q, want the token handed out by the close node %q", cached.Token, closeToken)
+	}
+}
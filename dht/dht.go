@@ -3,7 +3,9 @@ package dht
 import (
 	"bytes"
 	"crypto/sha1"
+	"math/rand"
 	"sort"
+	"sync"
 	"time"
 
 	b58 "github.com/jbenet/go-base58"
@@ -32,15 +34,66 @@ const (
 
 	// the maximum time to wait for a response to any message
 	tMsgTimeout = 2
+
+	// how often a random bucket is picked for revalidation
+	tRevalidate = 5
+
+	// the number of contacts, seen while their bucket was full, kept per
+	// bucket as standbys for a dead bucket entry
+	replacementCacheSize = 10
 )
 
 // DHT TODO
 type DHT struct {
-	ht         *hashTable
-	options    *Options
-	networking networking
-	store      Store
-	msgCounter int64
+	ht            *hashTable
+	options       *Options
+	networking    networking
+	store         Store
+	providerStore ProviderStore
+	msgCounter    int64
+
+	// providedKeys is the set of keys this node has announced itself as a
+	// provider for, so the republish loop knows what to re-announce.
+	providedKeys      map[string]bool
+	providedKeysMutex sync.Mutex
+
+	// replacements holds, per bucket index, the contacts that were seen
+	// while that bucket was already full. They stand by to fill the slot
+	// left by an entry that fails revalidation instead of being dropped.
+	replacements      map[int][]*node
+	replacementsMutex sync.Mutex
+
+	// timestamps tracks when a contact was first added and when it was
+	// last confirmed alive, keyed by its string-encoded ID. This lives on
+	// the DHT rather than on node itself so it can be looked up without
+	// holding the routing table lock.
+	timestamps      map[string]*nodeTimestamps
+	timestampsMutex sync.Mutex
+
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	// bucketLastLookup records the last time a lookup touched each bucket
+	// index, so the refresh loop can tell which buckets have gone stale.
+	bucketLastLookup      map[int]time.Time
+	bucketLastLookupMutex sync.Mutex
+
+	// netSet caps how many routing table entries may share the same /24
+	// (IPv4) or /48 (IPv6) prefix, so a single subnet can't sybil-flood the
+	// table.
+	netSet *DistinctNetSet
+
+	// tokens authorizes messageTypeQueryStore requests, so storage can't be
+	// spammed by a node that never did a find-node/find-value lookup first.
+	tokens *tokenManager
+}
+
+// nodeTimestamps records when a contact entered the routing table and when
+// it was last heard from, so that seeding and revalidation can prefer
+// long-lived entries over recently-seen ones.
+type nodeTimestamps struct {
+	addedAt  time.Time
+	lastSeen time.Time
 }
 
 // Options TODO
@@ -50,6 +103,34 @@ type Options struct {
 	Port           string
 	BootstrapNodes []*NetworkNode
 	ContactTimeout *time.Time
+
+	// ProviderTTL overrides how long a provider record held by this node -
+	// its own, and those other nodes announce to it - stays valid before it
+	// expires. Defaults to defaultProviderTTL (24h) when zero.
+	ProviderTTL time.Duration
+
+	// NetRestrict, if set, restricts bootstrapping and incoming traffic to
+	// the given IP ranges. Nodes outside every listed range are refused
+	// before they ever reach the routing table.
+	NetRestrict *Netlist
+
+	// AllowLAN opts out of the default rejection of loopback, link-local,
+	// and private-range addresses (see IsSpecial) as routing table entries
+	// and message senders. Leave false in production, where a peer
+	// claiming one of those addresses is either misconfigured or hostile;
+	// set true for local multi-node testing.
+	AllowLAN bool
+
+	// TokenRotationInterval overrides how often the store-authorization
+	// secret rotates. Defaults to defaultTokenRotationInterval (5m) when
+	// zero.
+	TokenRotationInterval time.Duration
+
+	// TODO(chunk0-6): configurable hash function (e.g. SHA-256) with a
+	// widened nodeIDLength was attempted here and reverted - the plumbing
+	// through newID, bucket indexing, and getBucketIndexFromDifferingBit
+	// wasn't complete enough to land safely. SHA-1/20-byte IDs remain
+	// hardcoded until that's picked back up.
 }
 
 // NewDHT TODO
@@ -63,20 +144,40 @@ func NewDHT(store Store, options *Options) (*DHT, error) {
 	dht.store = store
 	dht.ht = ht
 	dht.networking = &realNetworking{}
+	dht.replacements = make(map[int][]*node)
+	dht.timestamps = make(map[string]*nodeTimestamps)
+	dht.bucketLastLookup = make(map[int]time.Time)
+	dht.providerStore = newMemoryProviderStore()
+	dht.providedKeys = make(map[string]bool)
+	dht.netSet = &DistinctNetSet{Subnet4: 24, Subnet6: 48, Limit: maxPerSubnet}
+	dht.tokens = newTokenManager()
+	dht.stop = make(chan struct{})
 	return dht, nil
 }
 
-// Store TODO
+// Store computes the SHA-1 hash of data and stores it under that key.
 func (dht *DHT) Store(data []byte) (string, error) {
-	sha := sha1.New()
-	key := sha.Sum(data)
-	dht.store.Store(key, data)
-	_, _, err := dht.iterate(iterateStore, key[:], data)
+	h := sha1.New()
+	h.Write(data)
+	key := h.Sum(nil)
+	return dht.storeWithKeyBytes(key, data)
+}
+
+// StoreWithKey stores data under a caller-supplied key instead of one
+// derived from the content, for callers that already have their own
+// addressing scheme.
+func (dht *DHT) StoreWithKey(key string, data []byte) (string, error) {
+	return dht.storeWithKeyBytes(b58.Decode(key), data)
+}
+
+func (dht *DHT) storeWithKeyBytes(key []byte, data []byte) (string, error) {
+	expiration := time.Now().Add(time.Second * tExpire)
+	dht.store.Store(key, data, expiration, true)
+	_, _, err := dht.iterate(iterateStore, key, data, expiration, true)
 	if err != nil {
 		return "", err
 	}
-	str := b58.Encode(key)
-	return str, nil
+	return b58.Encode(key), nil
 }
 
 // Get TODO
@@ -85,7 +186,7 @@ func (dht *DHT) Get(key string) ([]byte, bool, error) {
 	value, exists := dht.store.Retrieve(keyBytes)
 	if !exists {
 		var err error
-		value, _, err = dht.iterate(iterateFindValue, keyBytes, nil)
+		value, _, err = dht.iterate(iterateFindValue, keyBytes, nil, time.Time{}, false)
 		if err != nil {
 			return nil, false, err
 		}
@@ -116,42 +217,227 @@ func (dht *DHT) CreateSocket() error {
 
 func (dht *DHT) Listen() error {
 	go dht.listen()
+	go dht.revalidate()
+	go dht.expireLoop()
+	go dht.republishLoop()
+	go dht.replicateLoop()
+	go dht.refreshLoop()
+	go dht.provideRepublishLoop()
+	go dht.tokenRotateLoop()
 	return dht.networking.listen()
 }
 
 func (dht *DHT) Bootstrap() error {
 	if len(dht.options.BootstrapNodes) > 0 {
 		for _, bn := range dht.options.BootstrapNodes {
+			if !dht.ipAllowed(bn.IP) {
+				continue
+			}
 			node := newNode(bn)
 			dht.addNode(node)
 		}
 	}
-	_, _, err := dht.iterate(iterateFindNode, dht.ht.Self.ID, nil)
+	_, _, err := dht.iterate(iterateFindNode, dht.ht.Self.ID, nil, time.Time{}, false)
 	return err
 }
 
-// Disconnect TODO
+// Stop terminates the DHT's background maintenance goroutines (bucket
+// revalidation, expiry, republish/replicate, bucket refresh, provider
+// republish and token rotation) without
+// touching the network socket.
+func (dht *DHT) Stop() {
+	dht.stopOnce.Do(func() {
+		close(dht.stop)
+	})
+}
+
+// Disconnect stops the background maintenance goroutines and closes the
+// underlying network socket.
 func (dht *DHT) Disconnect() error {
+	dht.Stop()
 	return dht.networking.disconnect()
 }
 
+// expireLoop periodically purges key/value pairs whose TTL has elapsed.
+func (dht *DHT) expireLoop() {
+	ticker := time.NewTicker(time.Second * tRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			dht.store.ExpireKeys()
+		case <-dht.stop:
+			return
+		}
+	}
+}
+
+// republishLoop re-announces every key/value pair this node is the
+// original publisher of, so that it survives churn in the nodes that
+// replicated it.
+func (dht *DHT) republishLoop() {
+	ticker := time.NewTicker(time.Second * tRepublish)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, k := range dht.store.GetAllKeysForRefresh() {
+				keyBytes := []byte(k)
+				if !dht.store.IsPublisher(keyBytes) {
+					continue
+				}
+				data, exists := dht.store.Retrieve(keyBytes)
+				if !exists {
+					continue
+				}
+				expiration := time.Now().Add(time.Second * tExpire)
+				dht.iterate(iterateStore, keyBytes, data, expiration, true)
+			}
+		case <-dht.stop:
+			return
+		}
+	}
+}
+
+// replicateLoop re-stores key/value pairs this node holds as a replica
+// (not the original publisher), per the standard Kademlia replication
+// interval.
+func (dht *DHT) replicateLoop() {
+	ticker := time.NewTicker(time.Second * tReplicated)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, k := range dht.store.GetAllKeysForRefresh() {
+				keyBytes := []byte(k)
+				if dht.store.IsPublisher(keyBytes) {
+					continue
+				}
+				data, exists := dht.store.Retrieve(keyBytes)
+				if !exists {
+					continue
+				}
+				expiration := time.Now().Add(time.Second * tExpire)
+				dht.iterate(iterateStore, keyBytes, data, expiration, false)
+			}
+		case <-dht.stop:
+			return
+		}
+	}
+}
+
+// refreshLoop looks for k-buckets that haven't had a lookup touch them in
+// tRefresh seconds and performs a find-node against a random ID within
+// that bucket's range, so stale parts of the routing table stay populated.
+func (dht *DHT) refreshLoop() {
+	ticker := time.NewTicker(time.Second * tRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			dht.refreshStaleBuckets()
+		case <-dht.stop:
+			return
+		}
+	}
+}
+
+func (dht *DHT) refreshStaleBuckets() {
+	dht.ht.mutex.Lock()
+	indices := make([]int, 0, len(dht.ht.RoutingTable))
+	for i, bucket := range dht.ht.RoutingTable {
+		if len(bucket) > 0 {
+			indices = append(indices, i)
+		}
+	}
+	dht.ht.mutex.Unlock()
+
+	now := time.Now()
+	for _, index := range indices {
+		dht.bucketLastLookupMutex.Lock()
+		last, ok := dht.bucketLastLookup[index]
+		dht.bucketLastLookupMutex.Unlock()
+		if ok && now.Sub(last) < time.Second*tRefresh {
+			continue
+		}
+
+		randID := randomIDInBucket(dht.ht.Self.ID, index)
+		dht.iterate(iterateFindNode, randID, nil, time.Time{}, false)
+	}
+}
+
+// randomIDInBucket produces an ID that would fall into the bucket at the
+// given index relative to self: it agrees with self before the
+// bucket-defining bit, differs from it at that bit, keeps self's remaining
+// bits of that byte, and is random from the next byte on.
+func randomIDInBucket(self []byte, index int) []byte {
+	id := make([]byte, len(self))
+	copy(id, self)
+
+	byteIndex := index / 8
+	bitIndex := uint(index % 8)
+	if byteIndex >= len(id) {
+		return id
+	}
+
+	id[byteIndex] ^= 1 << (7 - bitIndex)
+	rand.Read(id[byteIndex+1:])
+	return id
+}
+
 // Iterate does an iterative search through the network. This can be done
 // for multiple reasons. These reasons include:
-//     iterativeStore - Used to store new information in the network.
-//     iterativeFindNode - Used to bootstrap the network.
-//     iterativeFindValue - Used to find a value among the network given a key.
-func (dht *DHT) iterate(t int, target []byte, data []byte) (value []byte, closest []*NetworkNode, err error) {
+//
+//	iterativeStore - Used to store new information in the network.
+//	iterativeFindNode - Used to bootstrap the network.
+//	iterativeFindValue - Used to find a value among the network given a key.
+//	iterateFindProviders - Used to gather provider records for a key,
+//	    optionally announcing this node as one of them once the walk
+//	    settles; accumulated providers are returned via closest.
+func (dht *DHT) iterate(t int, target []byte, data []byte, expiration time.Time, publisher bool) (value []byte, closest []*NetworkNode, err error) {
+	dht.touchBucketLookup(target)
 	sl := dht.ht.getClosestContacts(alpha, target, []*NetworkNode{})
 
 	// We keep track of nodes contacted so far. We don't contact the same node
 	// twice.
 	var contacted = make(map[string]bool)
 
+	// storeTokens remembers the write-authorization token each node handed
+	// back in its find-node response, so the final store broadcast can send
+	// each recipient the token it's actually expecting.
+	storeTokens := make(map[string][]byte)
+
+	// findValueTokens remembers, for each node that answered a find-value
+	// query without the value, the write-authorization token it handed back,
+	// so a value can be cached at the closest node that missed it without a
+	// separate round trip.
+	findValueTokens := make(map[string][]byte)
+
+	// providersSeen/providersFound accumulate provider announcements from
+	// every node visited during an iterateFindProviders walk, since unlike
+	// the other iterate types it doesn't short-circuit on the first hit.
+	providersSeen := make(map[string]bool)
+	var providersFound []*NetworkNode
+	addProviders := func(nodes []*NetworkNode) {
+		for _, n := range nodes {
+			if !providersSeen[string(n.ID)] {
+				providersSeen[string(n.ID)] = true
+				providersFound = append(providersFound, n)
+			}
+		}
+	}
+
 	// We keep a reference to the closestNode. If after performing a search
 	// we do not find a closer node, we stop searching.
 	if len(sl.Nodes) == 0 {
+		if t == iterateFindProviders {
+			return nil, dht.providerStore.GetProviders(target), nil
+		}
 		return nil, nil, nil
 	}
+	if t == iterateFindProviders {
+		addProviders(dht.providerStore.GetProviders(target))
+	}
 
 	closestNode := sl.Nodes[0]
 
@@ -192,6 +478,9 @@ func (dht *DHT) iterate(t int, target []byte, data []byte) (value []byte, closes
 				queryData := &queryDataFindNode{}
 				queryData.Target = target
 				query.Data = queryData
+			case iterateFindProviders:
+				query.Type = messageTypeQueryGetProviders
+				query.Data = &queryDataGetProviders{Key: target}
 			default:
 				panic("Unknown iterate type")
 			}
@@ -232,28 +521,52 @@ func (dht *DHT) iterate(t int, target []byte, data []byte) (value []byte, closes
 			switch t {
 			case iterateFindNode:
 				responseData := result.Data.(*responseDataFindNode)
-				for _, n := range responseData.Closest {
+				closest := dht.filterAllowed(responseData.Closest)
+				for _, n := range closest {
 					dht.addNode(newNode(n))
 				}
-				sl.AppendUniqueNetworkNodes(responseData.Closest)
+				sl.AppendUniqueNetworkNodes(closest)
 			case iterateFindValue:
 				responseData := result.Data.(*responseDataFindValue)
-				// TODO When an iterativeFindValue succeeds, the initiator must
-				// store the key/value pair at the closest node seen which did
-				// not return the value.
 				if responseData.Value != nil {
+					// The standard Kademlia caching rule: store the value at
+					// the closest node seen so far that did not have it,
+					// using the write token it handed out, so frequently
+					// requested values migrate toward their key. The
+					// shortlist is sorted by distance, so the first missed
+					// node in it is the closest one.
+					for _, n := range sl.Nodes {
+						if token, missed := findValueTokens[string(n.ID)]; missed {
+							dht.cacheValueAt(n, token, target, responseData.Value)
+							break
+						}
+					}
 					return responseData.Value, nil, nil
 				}
-				for _, n := range responseData.Closest {
+				findValueTokens[string(result.Sender.ID)] = responseData.Token
+				closest := dht.filterAllowed(responseData.Closest)
+				for _, n := range closest {
 					dht.addNode(newNode(n))
 				}
-				sl.AppendUniqueNetworkNodes(responseData.Closest)
+				sl.AppendUniqueNetworkNodes(closest)
 			case iterateStore:
 				responseData := result.Data.(*responseDataFindNode)
-				for _, n := range responseData.Closest {
+				if len(responseData.Token) > 0 {
+					storeTokens[string(result.Sender.ID)] = responseData.Token
+				}
+				closest := dht.filterAllowed(responseData.Closest)
+				for _, n := range closest {
+					dht.addNode(newNode(n))
+				}
+				sl.AppendUniqueNetworkNodes(closest)
+			case iterateFindProviders:
+				responseData := result.Data.(*responseDataGetProviders)
+				addProviders(responseData.Providers)
+				closest := dht.filterAllowed(responseData.Closest)
+				for _, n := range closest {
 					dht.addNode(newNode(n))
 				}
-				sl.AppendUniqueNetworkNodes(responseData.Closest)
+				sl.AppendUniqueNetworkNodes(closest)
 			}
 		}
 
@@ -266,6 +579,16 @@ func (dht *DHT) iterate(t int, target []byte, data []byte) (value []byte, closes
 			case iterateFindNode:
 				return nil, sl.Nodes, nil
 			case iterateFindValue:
+				// Before giving up, ask any of the alpha closest nodes that
+				// have not been queried yet, since one of them may hold the
+				// value even though it is not closer than closestNode.
+				pending := false
+				for i := 0; i < len(sl.Nodes) && i < alpha; i++ {
+					pending = pending || !contacted[string(sl.Nodes[i].ID)]
+				}
+				if pending {
+					continue
+				}
 				return nil, sl.Nodes, nil
 			case iterateStore:
 				for i, n := range sl.Nodes {
@@ -273,6 +596,16 @@ func (dht *DHT) iterate(t int, target []byte, data []byte) (value []byte, closes
 						return nil, nil, nil
 					}
 
+					token, ok := storeTokens[string(n.ID)]
+					if !ok {
+						// n was only ever discovered as someone else's
+						// "closest" result, so we never queried it directly
+						// and never received a token from it. Without one
+						// its store would be silently rejected, so fetch one
+						// now with a direct find-node round trip.
+						token = dht.fetchToken(n, target)
+					}
+
 					query := &message{}
 					query.Receiver = n
 					query.Sender = dht.ht.Self
@@ -280,11 +613,30 @@ func (dht *DHT) iterate(t int, target []byte, data []byte) (value []byte, closes
 					queryData := &queryDataStore{}
 					queryData.Data = data
 					queryData.Key = target
+					queryData.Expiration = expiration
+					queryData.Publisher = publisher
+					queryData.Token = token
 					query.Data = queryData
 					dht.networking.sendMessage(query, dht.msgCounter, false)
 					dht.msgCounter++
 				}
 				return nil, nil, nil
+			case iterateFindProviders:
+				if publisher {
+					for i, n := range sl.Nodes {
+						if i >= k {
+							break
+						}
+						query := &message{}
+						query.Sender = dht.ht.Self
+						query.Receiver = n
+						query.Type = messageTypeQueryAddProvider
+						query.Data = &queryDataAddProvider{Key: target}
+						dht.networking.sendMessage(query, dht.msgCounter, false)
+						dht.msgCounter++
+					}
+				}
+				return nil, providersFound, nil
 			}
 		} else {
 			closestNode = sl.Nodes[0]
@@ -292,10 +644,67 @@ func (dht *DHT) iterate(t int, target []byte, data []byte) (value []byte, closes
 	}
 }
 
+// cacheValueAt stores a value at a node that was passed over during a
+// find-value lookup, so that popular values migrate toward nodes closer to
+// their key. It is a no-op if n is nil or is this node itself.
+func (dht *DHT) cacheValueAt(n *NetworkNode, token []byte, key []byte, value []byte) {
+	if n == nil || bytes.Compare(n.ID, dht.ht.Self.ID) == 0 {
+		return
+	}
+
+	query := &message{}
+	query.Sender = dht.ht.Self
+	query.Receiver = n
+	query.Type = messageTypeQueryStore
+	queryData := &queryDataStore{}
+	queryData.Key = key
+	queryData.Data = value
+	queryData.Expiration = time.Now().Add(time.Second * tExpire)
+	queryData.Publisher = false
+	queryData.Token = token
+	query.Data = queryData
+	dht.networking.sendMessage(query, dht.msgCounter, false)
+	dht.msgCounter++
+}
+
+// fetchToken directly queries n for a write-authorization token, for use
+// when n is a final store recipient that was only ever seen indirectly (in
+// another node's find-node response) and so never handed us one itself. It
+// returns nil if n doesn't respond or the response carries no token.
+func (dht *DHT) fetchToken(n *NetworkNode, target []byte) []byte {
+	query := &message{}
+	query.Sender = dht.ht.Self
+	query.Receiver = n
+	query.Type = messageTypeQueryFindNode
+	queryData := &queryDataFindNode{}
+	queryData.Target = target
+	query.Data = queryData
+
+	ch, err := dht.networking.sendMessage(query, dht.msgCounter, true)
+	dht.msgCounter++
+	if err != nil {
+		return nil
+	}
+
+	result := <-ch
+	if result.Error != nil {
+		return nil
+	}
+	responseData, ok := result.Data.(*responseDataFindNode)
+	if !ok {
+		return nil
+	}
+	return responseData.Token
+}
+
 // addNode adds a node into the appropriate k bucket
 // we store these buckets in big-endian order so we look at the bits
 // from right to left in order to find the appropriate bucket
 func (dht *DHT) addNode(node *node) {
+	if !dht.ipAllowed(node.IP) {
+		return
+	}
+
 	dht.ht.mutex.Lock()
 	defer dht.ht.mutex.Unlock()
 
@@ -321,22 +730,228 @@ func (dht *DHT) addNode(node *node) {
 		ch, err := dht.networking.sendMessage(query, dht.msgCounter, true)
 		dht.msgCounter++
 		if err != nil {
+			dht.netSet.Remove(bucket[0].IP)
+			if !dht.netSet.Add(node.IP) {
+				return
+			}
 			bucket = append(bucket, node)
 			bucket = bucket[1:]
 		} else {
 			select {
 			case <-ch:
+				// The bucket head is still alive, so the new contact is
+				// kept on standby rather than being dropped on the floor.
+				dht.addReplacement(index, node)
 				return
 			case <-time.After(time.Second * tPingMax):
+				dht.netSet.Remove(bucket[0].IP)
+				if !dht.netSet.Add(node.IP) {
+					return
+				}
 				bucket = append(bucket, node)
 				bucket = bucket[1:]
 			}
 		}
 	} else {
+		if !dht.netSet.Add(node.IP) {
+			return
+		}
 		bucket = append(bucket, node)
 	}
 
+	dht.touchTimestamps(node)
+	dht.ht.RoutingTable[index] = bucket
+}
+
+// touchTimestamps records the first-seen time for a newly added contact and
+// refreshes its last-seen time.
+func (dht *DHT) touchTimestamps(n *node) {
+	dht.timestampsMutex.Lock()
+	defer dht.timestampsMutex.Unlock()
+	ts, ok := dht.timestamps[string(n.ID)]
+	if !ok {
+		ts = &nodeTimestamps{addedAt: time.Now()}
+		dht.timestamps[string(n.ID)] = ts
+	}
+	ts.lastSeen = time.Now()
+}
+
+// addReplacement adds a contact to the bounded standby list for a full
+// bucket, so it can be promoted later if a current entry fails
+// revalidation.
+func (dht *DHT) addReplacement(index int, n *node) {
+	dht.touchTimestamps(n)
+
+	dht.replacementsMutex.Lock()
+	defer dht.replacementsMutex.Unlock()
+
+	list := dht.replacements[index]
+	for _, r := range list {
+		if bytes.Compare(r.ID, n.ID) == 0 {
+			return
+		}
+	}
+
+	list = append(list, n)
+	if len(list) > replacementCacheSize {
+		list = list[len(list)-replacementCacheSize:]
+	}
+	dht.replacements[index] = list
+}
+
+// popReplacement removes and returns the oldest standby contact for a
+// bucket, or nil if there isn't one.
+func (dht *DHT) popReplacement(index int) *node {
+	dht.replacementsMutex.Lock()
+	list := dht.replacements[index]
+	if len(list) == 0 {
+		dht.replacementsMutex.Unlock()
+		return nil
+	}
+
+	// Prefer the longest-lived standby: a contact that has been around
+	// since before more recent arrivals is less likely to be a transient
+	// entry, so it's a better bet to fill the newly-freed slot.
+	best := 0
+	bestAddedAt := dht.addedAt(list[0].ID)
+	for i := 1; i < len(list); i++ {
+		if t := dht.addedAt(list[i].ID); t.Before(bestAddedAt) {
+			best, bestAddedAt = i, t
+		}
+	}
+
+	n := list[best]
+	list = append(list[:best], list[best+1:]...)
+	dht.replacements[index] = list
+	dht.replacementsMutex.Unlock()
+	return n
+}
+
+// addedAt returns the recorded first-seen time for a contact, or the zero
+// time if it was never tracked.
+func (dht *DHT) addedAt(id []byte) time.Time {
+	dht.timestampsMutex.Lock()
+	defer dht.timestampsMutex.Unlock()
+	if ts, ok := dht.timestamps[string(id)]; ok {
+		return ts.addedAt
+	}
+	return time.Time{}
+}
+
+// touchBucketLookup marks the bucket a target ID falls into as having just
+// been looked up, exempting it from the next refresh pass.
+func (dht *DHT) touchBucketLookup(target []byte) {
+	index := dht.ht.getBucketIndexFromDifferingBit(dht.ht.Self.ID, target)
+	dht.bucketLastLookupMutex.Lock()
+	dht.bucketLastLookup[index] = time.Now()
+	dht.bucketLastLookupMutex.Unlock()
+}
+
+// revalidate periodically pings the least-recently-seen entry of a random
+// non-empty bucket, evicting and replacing it on failure. This stops dead
+// nodes that were never contacted again from rotting in a bucket forever.
+func (dht *DHT) revalidate() {
+	ticker := time.NewTicker(time.Second * tRevalidate)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			dht.revalidateRandomBucket()
+		case <-dht.stop:
+			return
+		}
+	}
+}
+
+func (dht *DHT) revalidateRandomBucket() {
+	dht.ht.mutex.Lock()
+	var nonEmpty []int
+	for i, bucket := range dht.ht.RoutingTable {
+		if len(bucket) > 0 {
+			nonEmpty = append(nonEmpty, i)
+		}
+	}
+	if len(nonEmpty) == 0 {
+		dht.ht.mutex.Unlock()
+		return
+	}
+	index := nonEmpty[rand.Intn(len(nonEmpty))]
+	bucket := dht.ht.RoutingTable[index]
+	// Bucket head is the least-recently-seen entry: addNode's full-bucket
+	// path pings bucket[0] to decide whether to evict it, and new/promoted
+	// entries are appended to the tail. Revalidation probes the same end.
+	oldest := bucket[0]
+	dht.ht.mutex.Unlock()
+
+	query := &message{}
+	query.Sender = dht.ht.Self
+	query.Receiver = oldest.NetworkNode
+	query.Type = messageTypeQueryPing
+	ch, err := dht.networking.sendMessage(query, dht.msgCounter, true)
+	dht.msgCounter++
+	if err != nil {
+		dht.evictAndReplace(index, oldest)
+		return
+	}
+
+	select {
+	case <-ch:
+		dht.promote(index, oldest)
+	case <-time.After(time.Second * tPingMax):
+		dht.evictAndReplace(index, oldest)
+	}
+}
+
+// promote moves a contact that just answered a revalidation ping to the
+// tail of its bucket - the same end addNode appends freshly-seen entries
+// to - and refreshes its last-seen time.
+func (dht *DHT) promote(index int, n *node) {
+	dht.ht.mutex.Lock()
+	bucket := dht.ht.RoutingTable[index]
+	for i, v := range bucket {
+		if bytes.Compare(v.ID, n.ID) == 0 {
+			bucket = append(bucket[:i], bucket[i+1:]...)
+			bucket = append(bucket, v)
+			break
+		}
+	}
+	dht.ht.RoutingTable[index] = bucket
+	dht.ht.mutex.Unlock()
+
+	dht.timestampsMutex.Lock()
+	if ts, ok := dht.timestamps[string(n.ID)]; ok {
+		ts.lastSeen = time.Now()
+	}
+	dht.timestampsMutex.Unlock()
+}
+
+// evictAndReplace drops a contact that failed revalidation from its bucket
+// and, if one is available, promotes a standby from the replacement cache
+// into the freed slot.
+func (dht *DHT) evictAndReplace(index int, dead *node) {
+	dht.ht.mutex.Lock()
+	bucket := dht.ht.RoutingTable[index]
+	for i, v := range bucket {
+		if bytes.Compare(v.ID, dead.ID) == 0 {
+			bucket = append(bucket[:i], bucket[i+1:]...)
+			break
+		}
+	}
+	dht.netSet.Remove(dead.IP)
+
+	if replacement := dht.popReplacement(index); replacement != nil {
+		if dht.netSet.Add(replacement.IP) {
+			bucket = append(bucket, replacement)
+			dht.touchTimestamps(replacement)
+		}
+	}
+
 	dht.ht.RoutingTable[index] = bucket
+	dht.ht.mutex.Unlock()
+
+	dht.timestampsMutex.Lock()
+	delete(dht.timestamps, string(dead.ID))
+	dht.timestampsMutex.Unlock()
 }
 
 func (dht *DHT) listen() {
@@ -347,6 +962,9 @@ func (dht *DHT) listen() {
 			dht.networking.getMessageFin()
 			return
 		}
+		if !dht.ipAllowed(msg.Sender.IP) {
+			continue
+		}
 		switch msg.Type {
 		case messageTypeQueryFindNode:
 			data := msg.Data.(*queryDataFindNode)
@@ -358,6 +976,7 @@ func (dht *DHT) listen() {
 			response.Type = messageTypeResponseFindNode
 			responseData := &responseDataFindNode{}
 			responseData.Closest = closest.Nodes
+			responseData.Token = dht.tokens.token(msg.Sender.IP, msg.Sender.Port)
 			response.Data = responseData
 			dht.networking.sendMessage(response, msg.ID, false)
 		case messageTypeQueryFindValue:
@@ -370,6 +989,7 @@ func (dht *DHT) listen() {
 			response.Sender = dht.ht.Self
 			response.Type = messageTypeResponseFindValue
 			responseData := &responseDataFindValue{}
+			responseData.Token = dht.tokens.token(msg.Sender.IP, msg.Sender.Port)
 			if exists {
 				responseData.Value = value
 			} else {
@@ -381,7 +1001,37 @@ func (dht *DHT) listen() {
 		case messageTypeQueryStore:
 			data := msg.Data.(*queryDataStore)
 			dht.addNode(newNode(msg.Sender))
-			dht.store.Store(data.Key, data.Data)
+			if !dht.tokens.valid(data.Token, msg.Sender.IP, msg.Sender.Port) {
+				continue
+			}
+			dht.store.Store(data.Key, data.Data, data.Expiration, data.Publisher)
+		case messageTypeQueryAddProvider:
+			data := msg.Data.(*queryDataAddProvider)
+			dht.addNode(newNode(msg.Sender))
+			ttl := dht.options.ProviderTTL
+			if ttl == 0 {
+				ttl = defaultProviderTTL
+			}
+			dht.providerStore.AddProvider(data.Key, msg.Sender, time.Now().Add(ttl))
+			response := &message{IsResponse: true}
+			response.Sender = dht.ht.Self
+			response.Receiver = msg.Sender
+			response.Type = messageTypeResponseAddProvider
+			response.Data = &responseDataAddProvider{}
+			dht.networking.sendMessage(response, msg.ID, false)
+		case messageTypeQueryGetProviders:
+			data := msg.Data.(*queryDataGetProviders)
+			dht.addNode(newNode(msg.Sender))
+			response := &message{IsResponse: true}
+			response.Sender = dht.ht.Self
+			response.Receiver = msg.Sender
+			response.Type = messageTypeResponseGetProviders
+			responseData := &responseDataGetProviders{}
+			responseData.Providers = dht.providerStore.GetProviders(data.Key)
+			closest := dht.ht.getClosestContacts(k, data.Key, []*NetworkNode{msg.Sender})
+			responseData.Closest = closest.Nodes
+			response.Data = responseData
+			dht.networking.sendMessage(response, msg.ID, false)
 		case messageTypeQueryPing:
 			response := &message{IsResponse: true}
 			response.Sender = dht.ht.Self
@@ -390,4 +1040,4 @@ func (dht *DHT) listen() {
 			dht.networking.sendMessage(response, msg.ID, false)
 		}
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,69 @@
+package dht
+
+import "time"
+
+// message is the envelope every request/response travels in. Data holds
+// one of the queryData*/responseData* payloads below, keyed by Type.
+type message struct {
+	ID         int64
+	IsResponse bool
+	Sender     *NetworkNode
+	Receiver   *NetworkNode
+	Type       int
+	Data       interface{}
+	Error      error
+}
+
+// Core wire message types. Subsystems added later (see providers.go) keep
+// their own iota block offset well past this one so the two can never
+// collide.
+const (
+	messageTypeQueryFindNode = iota
+	messageTypeResponseFindNode
+	messageTypeQueryFindValue
+	messageTypeResponseFindValue
+	messageTypeQueryStore
+	messageTypeQueryPing
+	messageTypeResponsePing
+)
+
+// queryDataFindNode asks a node for its k closest contacts to Target.
+type queryDataFindNode struct {
+	Target []byte
+}
+
+// responseDataFindNode returns the closest contacts the responder knows
+// of, plus the write-authorization token the sender should use if it
+// turns around and stores something here.
+type responseDataFindNode struct {
+	Closest []*NetworkNode
+	Token   []byte
+}
+
+// queryDataFindValue asks a node for the value behind Target, or failing
+// that its closest contacts to it.
+type queryDataFindValue struct {
+	Target []byte
+}
+
+// responseDataFindValue carries Value when the responder holds it, or
+// Closest when it doesn't - never both - plus a write-authorization token
+// for the sender, same as responseDataFindNode.
+type responseDataFindValue struct {
+	Value   []byte
+	Closest []*NetworkNode
+	Token   []byte
+}
+
+// queryDataStore asks a node to hold a key/value pair until Expiration.
+// Publisher marks whether the sender is the original publisher (subject
+// to republish) or a replica (subject to replication instead). Token must
+// match one the responder handed out in a prior find-node/find-value
+// response, or the store is refused.
+type queryDataStore struct {
+	Key        []byte
+	Data       []byte
+	Expiration time.Time
+	Publisher  bool
+	Token      []byte
+}
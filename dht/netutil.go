@@ -0,0 +1,168 @@
+package dht
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxPerSubnet is the default cap on how many routing table entries may
+// share the same /24 (IPv4) or /48 (IPv6) prefix.
+const maxPerSubnet = 10
+
+// Netlist is a list of IP networks used to restrict which peers this node
+// will bootstrap from or accept traffic from.
+type Netlist struct {
+	mutex sync.RWMutex
+	nets  []*net.IPNet
+}
+
+// Add parses a CIDR range (a bare IP is treated as a /32 or /128) and adds
+// it to the list.
+func (l *Netlist) Add(cidr string) error {
+	cidr = strings.TrimSpace(cidr)
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			return &net.ParseError{Type: "CIDR address", Text: cidr}
+		}
+		bits := 32
+		if ip.To4() == nil {
+			bits = 128
+		}
+		cidr = cidr + "/" + strconv.Itoa(bits)
+	}
+
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	l.nets = append(l.nets, n)
+	l.mutex.Unlock()
+	return nil
+}
+
+// Contains reports whether ip falls inside any of the list's ranges. A nil
+// *Netlist matches everything, meaning no restriction is configured.
+func (l *Netlist) Contains(ip net.IP) bool {
+	if l == nil {
+		return true
+	}
+
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	for _, n := range l.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsLAN reports whether ip is a loopback, link-local, or RFC1918/ULA
+// private address.
+func IsLAN(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+		return true
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4[0] == 10 ||
+			(ip4[0] == 172 && ip4[1]&0xf0 == 16) ||
+			(ip4[0] == 192 && ip4[1] == 168)
+	}
+	return ip.IsPrivate()
+}
+
+// IsSpecial reports whether ip is a LAN address or otherwise unsuitable to
+// treat as a routable internet peer (unspecified or multicast).
+func IsSpecial(ip net.IP) bool {
+	if ip == nil {
+		return true
+	}
+	return IsLAN(ip) || ip.IsUnspecified() || ip.IsMulticast()
+}
+
+// ipAllowed reports whether ip may be added to the routing table or
+// accepted as a message sender: it must fall inside options.NetRestrict
+// (if configured) and, unless Options.AllowLAN opts in, must not be a LAN
+// or otherwise non-routable address, since no genuine internet peer
+// should ever claim one of those.
+func (dht *DHT) ipAllowed(ip net.IP) bool {
+	if !dht.options.AllowLAN && IsSpecial(ip) {
+		return false
+	}
+	return dht.options.NetRestrict.Contains(ip)
+}
+
+// filterAllowed returns a new slice holding only the nodes whose IP is
+// permitted by ipAllowed; the input slice is never modified.
+func (dht *DHT) filterAllowed(nodes []*NetworkNode) []*NetworkNode {
+	allowed := make([]*NetworkNode, 0, len(nodes))
+	for _, n := range nodes {
+		if dht.ipAllowed(n.IP) {
+			allowed = append(allowed, n)
+		}
+	}
+	return allowed
+}
+
+// DistinctNetSet tracks how many entries share the same subnet prefix
+// across the whole routing table, so a single subnet cannot sybil-flood it
+// with contacts.
+type DistinctNetSet struct {
+	Subnet4 uint // prefix length kept for IPv4 keys
+	Subnet6 uint // prefix length kept for IPv6 keys
+	Limit   uint // maximum entries per prefix; 0 means unlimited
+
+	mutex   sync.Mutex
+	members map[string]uint
+}
+
+func (s *DistinctNetSet) key(ip net.IP) string {
+	bits := s.Subnet6
+	if ip4 := ip.To4(); ip4 != nil {
+		bits = s.Subnet4
+		ip = ip4
+	}
+	mask := net.CIDRMask(int(bits), len(ip)*8)
+	return ip.Mask(mask).String()
+}
+
+// Add reports whether ip can be added without exceeding the per-subnet
+// cap, recording it if so.
+func (s *DistinctNetSet) Add(ip net.IP) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.members == nil {
+		s.members = make(map[string]uint)
+	}
+	k := s.key(ip)
+	if s.Limit > 0 && s.members[k] >= s.Limit {
+		return false
+	}
+	s.members[k]++
+	return true
+}
+
+// Remove records that ip has left the set.
+func (s *DistinctNetSet) Remove(ip net.IP) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.members == nil {
+		return
+	}
+	k := s.key(ip)
+	if s.members[k] <= 1 {
+		delete(s.members, k)
+		return
+	}
+	s.members[k]--
+}
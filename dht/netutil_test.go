@@ -0,0 +1,71 @@
+package dht
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIsLANAndIsSpecial(t *testing.T) {
+	cases := []struct {
+		ip       string
+		wantLAN  bool
+		wantSpec bool
+	}{
+		{"127.0.0.1", true, true},
+		{"10.0.0.1", true, true},
+		{"172.16.5.4", true, true},
+		{"192.168.1.1", true, true},
+		{"169.254.1.1", true, true},
+		{"8.8.8.8", false, false},
+		{"0.0.0.0", false, true},
+	}
+	for _, c := range cases {
+		ip := net.ParseIP(c.ip)
+		if got := IsLAN(ip); got != c.wantLAN {
+			t.Errorf("IsLAN(%s) = %v, want %v", c.ip, got, c.wantLAN)
+		}
+		if got := IsSpecial(ip); got != c.wantSpec {
+			t.Errorf("IsSpecial(%s) = %v, want %v", c.ip, got, c.wantSpec)
+		}
+	}
+}
+
+func TestIPAllowedRejectsLANUnlessOptedIn(t *testing.T) {
+	self := newTestNode(t, 3000)
+	dht, _ := newTestDHT(self)
+
+	lan := net.ParseIP("192.168.1.5")
+	public := net.ParseIP("8.8.8.8")
+
+	dht.options.AllowLAN = false
+	if dht.ipAllowed(lan) {
+		t.Error("expected a LAN address to be rejected when AllowLAN is false")
+	}
+	if !dht.ipAllowed(public) {
+		t.Error("expected a public address to be allowed when AllowLAN is false")
+	}
+
+	dht.options.AllowLAN = true
+	if !dht.ipAllowed(lan) {
+		t.Error("expected a LAN address to be allowed once AllowLAN is true")
+	}
+}
+
+func TestIPAllowedHonorsNetRestrict(t *testing.T) {
+	self := newTestNode(t, 3000)
+	dht, _ := newTestDHT(self)
+	dht.options.AllowLAN = true
+
+	restrict := &Netlist{}
+	if err := restrict.Add("8.8.8.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	dht.options.NetRestrict = restrict
+
+	if dht.ipAllowed(net.ParseIP("8.8.8.8")) == false {
+		t.Error("expected an address inside NetRestrict to be allowed")
+	}
+	if dht.ipAllowed(net.ParseIP("1.2.3.4")) {
+		t.Error("expected an address outside NetRestrict to be rejected")
+	}
+}
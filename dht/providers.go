@@ -0,0 +1,185 @@
+package dht
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	b58 "github.com/jbenet/go-base58"
+)
+
+// Message types for the provider-record subsystem, kept in their own block
+// since they were added after the original wire protocol.
+const (
+	messageTypeQueryAddProvider = iota + 100
+	messageTypeResponseAddProvider
+	messageTypeQueryGetProviders
+	messageTypeResponseGetProviders
+)
+
+// iterateFindProviders is an iterate() type alongside iterateFindNode/
+// iterateFindValue/iterateStore, kept in its own block for the same reason
+// as the message types above: it was added after the original iterate
+// types and must not collide with them.
+const iterateFindProviders = 100
+
+// defaultProviderTTL is how long a provider announcement is trusted before
+// it must be refreshed, absent an Options.ProviderTTL override.
+const defaultProviderTTL = time.Hour * 24
+
+// providerRepublishInterval is how often this node re-announces the keys it
+// provides, mirroring tRepublish for stored values.
+const providerRepublishInterval = time.Hour * 22
+
+// ProviderStore is the provider-record analogue of Store: instead of
+// holding the bytes behind a key, it holds the set of nodes that have
+// announced they can serve the content behind it, each with its own
+// expiration.
+type ProviderStore interface {
+	AddProvider(key []byte, provider *NetworkNode, expiration time.Time)
+	GetProviders(key []byte) []*NetworkNode
+	ExpireProviders()
+}
+
+// providerEntry pairs a network node with when its announcement expires.
+type providerEntry struct {
+	node       *NetworkNode
+	expiration time.Time
+}
+
+// memoryProviderStore is the default in-memory ProviderStore, used unless a
+// caller wires up something else.
+type memoryProviderStore struct {
+	mutex     sync.Mutex
+	providers map[string][]*providerEntry
+}
+
+func newMemoryProviderStore() *memoryProviderStore {
+	return &memoryProviderStore{providers: make(map[string][]*providerEntry)}
+}
+
+func (s *memoryProviderStore) AddProvider(key []byte, node *NetworkNode, expiration time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	k := string(key)
+	for _, p := range s.providers[k] {
+		if bytes.Compare(p.node.ID, node.ID) == 0 {
+			p.expiration = expiration
+			return
+		}
+	}
+	s.providers[k] = append(s.providers[k], &providerEntry{node: node, expiration: expiration})
+}
+
+func (s *memoryProviderStore) GetProviders(key []byte) []*NetworkNode {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	var nodes []*NetworkNode
+	for _, p := range s.providers[string(key)] {
+		if now.Before(p.expiration) {
+			nodes = append(nodes, p.node)
+		}
+	}
+	return nodes
+}
+
+func (s *memoryProviderStore) ExpireProviders() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	for k, list := range s.providers {
+		kept := list[:0]
+		for _, p := range list {
+			if now.Before(p.expiration) {
+				kept = append(kept, p)
+			}
+		}
+		if len(kept) == 0 {
+			delete(s.providers, k)
+		} else {
+			s.providers[k] = kept
+		}
+	}
+}
+
+// queryDataAddProvider announces that the sender can serve the content
+// behind Key.
+type queryDataAddProvider struct {
+	Key []byte
+}
+
+// responseDataAddProvider acknowledges a provider announcement.
+type responseDataAddProvider struct{}
+
+// queryDataGetProviders asks a node for any providers it knows of for Key.
+type queryDataGetProviders struct {
+	Key []byte
+}
+
+// responseDataGetProviders returns any providers the responder knows about
+// for Key, alongside the closer contacts a plain find-node would return.
+type responseDataGetProviders struct {
+	Providers []*NetworkNode
+	Closest   []*NetworkNode
+}
+
+// Provide announces to the network that this node can serve the content
+// behind key. It is the content-routing counterpart to Store: rather than
+// pushing the bytes through the DHT, only the announcement travels.
+func (dht *DHT) Provide(key string) error {
+	keyBytes := b58.Decode(key)
+
+	dht.providedKeysMutex.Lock()
+	dht.providedKeys[key] = true
+	dht.providedKeysMutex.Unlock()
+
+	ttl := dht.options.ProviderTTL
+	if ttl == 0 {
+		ttl = defaultProviderTTL
+	}
+	dht.providerStore.AddProvider(keyBytes, dht.ht.Self.NetworkNode, time.Now().Add(ttl))
+
+	_, _, err := dht.iterate(iterateFindProviders, keyBytes, nil, time.Time{}, true)
+	return err
+}
+
+// FindProviders walks the network for nodes that have announced they can
+// serve the content behind key, returning up to count of them.
+func (dht *DHT) FindProviders(key string, count int) ([]*NetworkNode, error) {
+	_, providers, err := dht.iterate(iterateFindProviders, b58.Decode(key), nil, time.Time{}, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(providers) > count {
+		providers = providers[:count]
+	}
+	return providers, nil
+}
+
+// provideRepublishLoop periodically re-announces every key this node
+// provides, so the announcement outlives its TTL.
+func (dht *DHT) provideRepublishLoop() {
+	ticker := time.NewTicker(providerRepublishInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			dht.providerStore.ExpireProviders()
+			dht.providedKeysMutex.Lock()
+			keys := make([]string, 0, len(dht.providedKeys))
+			for k := range dht.providedKeys {
+				keys = append(keys, k)
+			}
+			dht.providedKeysMutex.Unlock()
+			for _, k := range keys {
+				dht.Provide(k)
+			}
+		case <-dht.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package dht
+
+import (
+	"bytes"
+	"testing"
+
+	b58 "github.com/jbenet/go-base58"
+)
+
+// TestFindProvidersWalksNetwork exercises FindProviders against a single
+// directly-reachable node that reports another node as a provider, asserting the
+// walk surfaces it through the shared iterate() machinery.
+func TestFindProvidersWalksNetwork(t *testing.T) {
+	self := newTestNode(t, 3000)
+	holder := newTestNode(t, 3001)
+	provider := newTestNode(t, 3002)
+
+	dht, netw := newTestDHT(self)
+
+	key := "test-key"
+
+	netw.handlers[string(holder.ID)] = func(q *message) *message {
+		return &message{
+			Sender:   holder.NetworkNode,
+			Receiver: self.NetworkNode,
+			Type:     messageTypeResponseGetProviders,
+			Data: &responseDataGetProviders{
+				Providers: []*NetworkNode{provider.NetworkNode},
+			},
+		}
+	}
+
+	index := dht.ht.getBucketIndexFromDifferingBit(self.ID, holder.ID)
+	dht.ht.RoutingTable[index] = []*node{holder}
+
+	got, err := dht.FindProviders(key, 10)
+	if err != nil {
+		t.Fatalf("FindProviders returned error: %v", err)
+	}
+	if len(got) != 1 || !bytes.Equal(got[0].ID, provider.ID) {
+		t.Fatalf("FindProviders returned %v, want [%x]", got, provider.ID)
+	}
+}
+
+// TestProvideAnnouncesToClosestNodes asserts that Provide both remembers
+// the key locally and tells the closest reachable node about it.
+func TestProvideAnnouncesToClosestNodes(t *testing.T) {
+	self := newTestNode(t, 3000)
+	closest := newTestNode(t, 3001)
+
+	dht, netw := newTestDHT(self)
+
+	key := "test-key"
+
+	netw.handlers[string(closest.ID)] = func(q *message) *message {
+		return &message{
+			Sender:   closest.NetworkNode,
+			Receiver: self.NetworkNode,
+			Type:     messageTypeResponseGetProviders,
+			Data:     &responseDataGetProviders{},
+		}
+	}
+
+	index := dht.ht.getBucketIndexFromDifferingBit(self.ID, closest.ID)
+	dht.ht.RoutingTable[index] = []*node{closest}
+
+	if err := dht.Provide(key); err != nil {
+		t.Fatalf("Provide returned error: %v", err)
+	}
+
+	if got := dht.providerStore.GetProviders(b58.Decode(key)); len(got) != 1 || !bytes.Equal(got[0].ID, self.ID) {
+		t.Fatalf("Provide did not record this node as a local provider: %v", got)
+	}
+
+	var announced bool
+	for _, sent := range netw.sent {
+		if sent.Type == messageTypeQueryAddProvider && bytes.Equal(sent.Receiver.ID, closest.ID) {
+			announced = true
+		}
+	}
+	if !announced {
+		t.Fatal("expected Provide to announce to the closest reachable node")
+	}
+}
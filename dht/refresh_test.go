@@ -0,0 +1,85 @@
+package dht
+
+import (
+	"testing"
+	"time"
+)
+
+// TestRandomIDInBucketFallsInBucket asserts the generated ID actually
+// differs from self at the bucket-defining bit (and agrees with it
+// beforehand), since refreshStaleBuckets relies on that to target the
+// right part of the keyspace.
+func TestRandomIDInBucketFallsInBucket(t *testing.T) {
+	self := newTestNode(t, 3000)
+	dht, _ := newTestDHT(self)
+
+	const index = 3
+	id := randomIDInBucket(self.ID, index)
+
+	if len(id) != len(self.ID) {
+		t.Fatalf("randomIDInBucket returned %d bytes, want %d", len(id), len(self.ID))
+	}
+	if got := dht.ht.getBucketIndexFromDifferingBit(self.ID, id); got != index {
+		t.Fatalf("randomIDInBucket(self, %d) landed in bucket %d", index, got)
+	}
+}
+
+// TestRefreshStaleBucketsSkipsRecentlyLookedUp asserts that a bucket
+// touched by a lookup within tRefresh is left untouched by the next
+// refresh pass.
+func TestRefreshStaleBucketsSkipsRecentlyLookedUp(t *testing.T) {
+	self := newTestNode(t, 3000)
+	fresh := newTestNode(t, 3001)
+
+	dht, netw := newTestDHT(self)
+
+	var queried bool
+	netw.handlers[string(fresh.ID)] = func(q *message) *message {
+		queried = true
+		return &message{
+			Sender:   fresh.NetworkNode,
+			Receiver: self.NetworkNode,
+			Type:     messageTypeResponseFindNode,
+			Data:     &responseDataFindNode{},
+		}
+	}
+
+	index := dht.ht.getBucketIndexFromDifferingBit(self.ID, fresh.ID)
+	dht.ht.RoutingTable[index] = []*node{fresh}
+	dht.bucketLastLookup[index] = time.Now()
+
+	dht.refreshStaleBuckets()
+
+	if queried {
+		t.Error("refreshStaleBuckets queried a bucket that was looked up recently")
+	}
+}
+
+// TestRefreshStaleBucketsQueriesStaleBucket asserts that a populated bucket
+// with no recorded lookup gets a find-node run against it.
+func TestRefreshStaleBucketsQueriesStaleBucket(t *testing.T) {
+	self := newTestNode(t, 3000)
+	stale := newTestNode(t, 3001)
+
+	dht, netw := newTestDHT(self)
+
+	var queried bool
+	netw.handlers[string(stale.ID)] = func(q *message) *message {
+		queried = true
+		return &message{
+			Sender:   stale.NetworkNode,
+			Receiver: self.NetworkNode,
+			Type:     messageTypeResponseFindNode,
+			Data:     &responseDataFindNode{},
+		}
+	}
+
+	index := dht.ht.getBucketIndexFromDifferingBit(self.ID, stale.ID)
+	dht.ht.RoutingTable[index] = []*node{stale}
+
+	dht.refreshStaleBuckets()
+
+	if !queried {
+		t.Error("refreshStaleBuckets did not query a bucket with no recorded lookup")
+	}
+}
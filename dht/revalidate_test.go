@@ -0,0 +1,72 @@
+package dht
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// TestRevalidatePingsBucketHead asserts that revalidation probes bucket[0]
+// - the same slot addNode's full-bucket path pings to decide whether to
+// evict - and not the tail, which is where freshly-seen entries land.
+func TestRevalidatePingsBucketHead(t *testing.T) {
+	self := newTestNode(t, 3000)
+	head := newTestNode(t, 3001)
+	tail := newTestNode(t, 3002)
+
+	dht, netw := newTestDHT(self)
+
+	pinged := make(chan *NetworkNode, 1)
+	netw.handlers[string(head.ID)] = func(q *message) *message {
+		pinged <- q.Receiver
+		return &message{Sender: head.NetworkNode, Receiver: self.NetworkNode, Type: messageTypeResponsePing}
+	}
+	netw.handlers[string(tail.ID)] = func(q *message) *message {
+		t.Fatalf("revalidation pinged the tail entry, want the head")
+		return nil
+	}
+
+	index := dht.ht.getBucketIndexFromDifferingBit(self.ID, head.ID)
+	dht.ht.RoutingTable[index] = []*node{head, tail}
+
+	dht.revalidateRandomBucket()
+
+	select {
+	case got := <-pinged:
+		if !bytes.Equal(got.ID, head.ID) {
+			t.Fatalf("pinged %x, want head %x", got.ID, head.ID)
+		}
+	default:
+		t.Fatal("revalidateRandomBucket never pinged the head entry")
+	}
+
+	bucket := dht.ht.RoutingTable[index]
+	if len(bucket) != 2 || !bytes.Equal(bucket[len(bucket)-1].ID, head.ID) {
+		t.Fatalf("head entry was not promoted to the tail after answering: %v", bucket)
+	}
+}
+
+// TestPopReplacementPrefersOldest asserts that, when a slot frees up, the
+// longest-lived standby in the replacement cache is promoted first.
+func TestPopReplacementPrefersOldest(t *testing.T) {
+	self := newTestNode(t, 3000)
+	older := newTestNode(t, 3001)
+	newer := newTestNode(t, 3002)
+
+	dht, _ := newTestDHT(self)
+
+	const index = 5
+	dht.addReplacement(index, newer)
+	time.Sleep(time.Millisecond)
+	dht.addReplacement(index, older)
+	// older was observed second but force its addedAt earlier to emulate
+	// a contact that has genuinely been around longer.
+	dht.timestampsMutex.Lock()
+	dht.timestamps[string(older.ID)].addedAt = dht.timestamps[string(newer.ID)].addedAt.Add(-time.Hour)
+	dht.timestampsMutex.Unlock()
+
+	got := dht.popReplacement(index)
+	if got == nil || !bytes.Equal(got.ID, older.ID) {
+		t.Fatalf("popReplacement returned %v, want the older standby %x", got, older.ID)
+	}
+}
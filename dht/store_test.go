@@ -0,0 +1,82 @@
+package dht
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// TestIterateStoreFetchesTokenForIndirectNode covers a node that is only
+// ever seen indirectly - named in another node's find-node response, but
+// never contacted directly because it didn't change the closest node and
+// so never triggered another round - and asserts it still gets a direct
+// round trip for a token before the final store broadcast, rather than
+// being sent (and silently dropped for) an empty one.
+func TestIterateStoreFetchesTokenForIndirectNode(t *testing.T) {
+	self := newTestNode(t, 3000)
+	direct := newTestNode(t, 3001)
+	indirect := newTestNode(t, 3002)
+
+	dht, netw := newTestDHT(self)
+
+	// Pin the key to direct's own ID so direct always sorts first and the
+	// walk ends after one round, leaving indirect never queried by it.
+	key := append([]byte(nil), direct.ID...)
+	data := []byte("test-value")
+	directToken := []byte("direct-token")
+	indirectToken := []byte("indirect-token")
+
+	netw.handlers[string(direct.ID)] = func(q *message) *message {
+		return &message{
+			Sender:   direct.NetworkNode,
+			Receiver: self.NetworkNode,
+			Type:     messageTypeResponseFindNode,
+			Data: &responseDataFindNode{
+				Closest: []*NetworkNode{indirect.NetworkNode},
+				Token:   directToken,
+			},
+		}
+	}
+	netw.handlers[string(indirect.ID)] = func(q *message) *message {
+		return &message{
+			Sender:   indirect.NetworkNode,
+			Receiver: self.NetworkNode,
+			Type:     messageTypeResponseFindNode,
+			Data:     &responseDataFindNode{Token: indirectToken},
+		}
+	}
+
+	index := dht.ht.getBucketIndexFromDifferingBit(self.ID, direct.ID)
+	dht.ht.RoutingTable[index] = []*node{direct}
+
+	_, _, err := dht.iterate(iterateStore, key, data, time.Now().Add(time.Hour), true)
+	if err != nil {
+		t.Fatalf("iterate returned error: %v", err)
+	}
+
+	stores := make(map[string]*queryDataStore)
+	for _, sent := range netw.sent {
+		if sent.Type == messageTypeQueryStore {
+			stores[string(sent.Receiver.ID)] = sent.Data.(*queryDataStore)
+		}
+	}
+
+	directStore, ok := stores[string(direct.ID)]
+	if !ok {
+		t.Fatal("expected a store to be sent to the directly-contacted node")
+	}
+	if !bytes.Equal(directStore.Token, directToken) {
+		t.Fatalf("direct node's store used token %q, want %q", directStore.Token, directToken)
+	}
+
+	indirectStore, ok := stores[string(indirect.ID)]
+	if !ok {
+		t.Fatal("expected a store to be sent to the indirectly-discovered node")
+	}
+	if len(indirectStore.Token) == 0 {
+		t.Fatal("indirectly-discovered node's store carried no token; it will be rejected as unauthorized")
+	}
+	if !bytes.Equal(indirectStore.Token, indirectToken) {
+		t.Fatalf("indirect node's store used token %q, want the one fetched from it directly %q", indirectStore.Token, indirectToken)
+	}
+}
@@ -0,0 +1,110 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultTokenRotationInterval is how often the write-authorization secret
+// rotates, absent an Options.TokenRotationInterval override.
+const defaultTokenRotationInterval = 5 * time.Minute
+
+// tokenManager hands out and verifies write-authorization tokens using the
+// BEP-5 / LBRY rotating-secret scheme: a token is HMAC(secret, senderIP ||
+// senderPort), and both the current and previous secret are accepted so a
+// token handed out just before a rotation doesn't go stale mid-lookup.
+type tokenManager struct {
+	mutex  sync.Mutex
+	secret []byte
+	prev   []byte
+}
+
+func newTokenManager() *tokenManager {
+	tm := &tokenManager{}
+	tm.secret = randomSecret()
+	return tm
+}
+
+func randomSecret() []byte {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return b
+}
+
+// rotate replaces the current secret with a fresh one, keeping the old one
+// around as the "previous" secret for verification.
+func (tm *tokenManager) rotate() {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	tm.prev = tm.secret
+	tm.secret = randomSecret()
+}
+
+func addrBytes(ip net.IP, port int) []byte {
+	var buf bytes.Buffer
+	buf.Write(ip)
+	buf.WriteString(strconv.Itoa(port))
+	return buf.Bytes()
+}
+
+func hmacToken(secret, addr []byte) []byte {
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(addr)
+	return mac.Sum(nil)
+}
+
+// token computes the current write-authorization token for a given
+// sender address.
+func (tm *tokenManager) token(ip net.IP, port int) []byte {
+	tm.mutex.Lock()
+	secret := tm.secret
+	tm.mutex.Unlock()
+	return hmacToken(secret, addrBytes(ip, port))
+}
+
+// valid reports whether tok matches either the current or previous secret
+// for the given sender address.
+func (tm *tokenManager) valid(tok []byte, ip net.IP, port int) bool {
+	if len(tok) == 0 {
+		return false
+	}
+
+	tm.mutex.Lock()
+	secret, prev := tm.secret, tm.prev
+	tm.mutex.Unlock()
+
+	addr := addrBytes(ip, port)
+	if hmac.Equal(tok, hmacToken(secret, addr)) {
+		return true
+	}
+	if prev != nil && hmac.Equal(tok, hmacToken(prev, addr)) {
+		return true
+	}
+	return false
+}
+
+// tokenRotateLoop rotates the write-authorization secret on
+// Options.TokenRotationInterval (defaultTokenRotationInterval if unset).
+func (dht *DHT) tokenRotateLoop() {
+	interval := dht.options.TokenRotationInterval
+	if interval == 0 {
+		interval = defaultTokenRotationInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			dht.tokens.rotate()
+		case <-dht.stop:
+			return
+		}
+	}
+}
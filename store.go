@@ -13,14 +13,16 @@ type Store interface {
 	Init()
 	GetAllKeysForRefresh() []string
 	ExpireKeys()
+	IsPublisher(key []byte) bool
 }
 
 // MemoryStore TODO
 type MemoryStore struct {
-	mutex      *sync.Mutex
-	data       map[string][]byte
-	refreshMap map[string]time.Time
-	expireMap  map[string]time.Time
+	mutex        *sync.Mutex
+	data         map[string][]byte
+	refreshMap   map[string]time.Time
+	expireMap    map[string]time.Time
+	publisherMap map[string]bool
 }
 
 // GetAllKeysForRefresh TODO
@@ -44,6 +46,7 @@ func (ms *MemoryStore) ExpireKeys() {
 		if time.Now().After(v) {
 			delete(ms.refreshMap, k)
 			delete(ms.expireMap, k)
+			delete(ms.publisherMap, k)
 			delete(ms.data, k)
 		}
 	}
@@ -55,6 +58,7 @@ func (ms *MemoryStore) Init() {
 	ms.mutex = &sync.Mutex{}
 	ms.refreshMap = make(map[string]time.Time)
 	ms.expireMap = make(map[string]time.Time)
+	ms.publisherMap = make(map[string]bool)
 }
 
 // Store TODO
@@ -63,10 +67,18 @@ func (ms *MemoryStore) Store(key []byte, data []byte, expiration time.Time, publ
 	defer ms.mutex.Unlock()
 	ms.refreshMap[string(key)] = time.Now().Add(time.Hour * 1)
 	ms.expireMap[string(key)] = expiration
+	ms.publisherMap[string(key)] = publisher
 	ms.data[string(key)] = data
 	return nil
 }
 
+// IsPublisher TODO
+func (ms *MemoryStore) IsPublisher(key []byte) bool {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	return ms.publisherMap[string(key)]
+}
+
 // Retrieve TODO
 func (ms *MemoryStore) Retrieve(key []byte) ([]byte, bool) {
 	ms.mutex.Lock()
@@ -80,4 +92,7 @@ func (ms *MemoryStore) Delete(key []byte) {
 	ms.mutex.Lock()
 	defer ms.mutex.Unlock()
 	delete(ms.data, string(key))
+	delete(ms.refreshMap, string(key))
+	delete(ms.expireMap, string(key))
+	delete(ms.publisherMap, string(key))
 }
\ No newline at end of file